@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	log "github.com/jcelliott/lumber"
+)
+
+// dsnOpener constructs a DB from the part of a DSN after the scheme,
+// e.g. "file_store" from "fs:file_store" or "localhost:5984/test" from
+// "couchdb:localhost:5984/test". Registering a scheme here is the only
+// change needed to make a new backend usable by convertdb.
+type dsnOpener func(rest string) (DB, error)
+
+var dsnOpeners = map[string]dsnOpener{
+	"fs": func(rest string) (DB, error) {
+		return NewFileStore(rest)
+	},
+	"couchdb": func(rest string) (DB, error) {
+		parts := strings.SplitN(rest, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("couchdb DSN must be addr/database, got %q", rest)
+		}
+		return NewCouchDB(parts[0], parts[1], "", "")
+	},
+	"sql": func(rest string) (DB, error) {
+		parts := strings.SplitN(rest, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("sql DSN must be driver:dsn, got %q", rest)
+		}
+		return NewSQLStore(parts[0], parts[1])
+	},
+}
+
+// openDSN opens a DB from a "scheme:rest" DSN, e.g. fs:file_store or
+// couchdb:localhost:5984/test.
+func openDSN(dsn string) (DB, error) {
+	parts := strings.SplitN(dsn, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid DSN %q, expected scheme:rest", dsn)
+	}
+	open, ok := dsnOpeners[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DSN scheme: %s", parts[0])
+	}
+	return open(parts[1])
+}
+
+// convertdbMain implements "stein convertdb", copying every user's
+// projects and tests from one DB backend to another, e.g.:
+//
+//	stein convertdb -from fs:file_store -to couchdb:localhost:5984/test
+func convertdbMain(args []string) error {
+	fset := flag.NewFlagSet("convertdb", flag.ExitOnError)
+	from := fset.String("from", "", "source DSN, e.g. fs:file_store")
+	to := fset.String("to", "", "destination DSN, e.g. couchdb:localhost:5984/test")
+	mode := fset.String("mode", "skip", "what to do when a test already exists at the destination: skip or overwrite")
+	fset.Parse(args)
+
+	if *from == "" || *to == "" {
+		return fmt.Errorf("both -from and -to are required")
+	}
+	if *mode != "skip" && *mode != "overwrite" {
+		return fmt.Errorf("invalid -mode %q, must be skip or overwrite", *mode)
+	}
+
+	src, err := openDSN(*from)
+	if err != nil {
+		return fmt.Errorf("opening -from %q: %s", *from, err)
+	}
+	dst, err := openDSN(*to)
+	if err != nil {
+		return fmt.Errorf("opening -to %q: %s", *to, err)
+	}
+
+	users, err := src.ListUsers()
+	if err != nil {
+		return fmt.Errorf("listing users: %s", err)
+	}
+
+	var copied, skipped int
+	for _, user := range users {
+		projects, err := src.GetProjects(user)
+		if err != nil {
+			return fmt.Errorf("listing projects for %s: %s", user, err)
+		}
+		for _, project := range projects {
+			tests, err := src.GetTests(user, project)
+			if err != nil {
+				return fmt.Errorf("listing tests for %s/%s: %s", user, project, err)
+			}
+			for _, test := range tests {
+				if *mode == "skip" {
+					if _, err := dst.GetTest(user, project, test); err == nil {
+						skipped++
+						continue
+					}
+				}
+
+				s, err := src.GetTest(user, project, test)
+				if err != nil {
+					return fmt.Errorf("reading %s/%s/%s: %s", user, project, test, err)
+				}
+				// Save resolves _rev conflicts on the CouchDB side by
+				// fetching the current rev before writing, so
+				// "overwrite" just means always calling Save.
+				if err := dst.Save(user, project, test, s); err != nil {
+					return fmt.Errorf("writing %s/%s/%s: %s", user, project, test, err)
+				}
+				copied++
+			}
+		}
+	}
+	log.Info("convertdb: copied %d test(s), skipped %d existing", copied, skipped)
+	return nil
+}
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"github.com/beatgammit/semver"
 	"github.com/beatgammit/stein"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 type CouchDB struct {
@@ -15,7 +19,7 @@ type CouchDB struct {
 	user, pass             string
 }
 
-func NewCouchDB(addr, database, user, pass string) (DB, error) {
+func NewCouchDB(addr, database, user, pass string) (*CouchDB, error) {
 	// it's possible the user wants https:// or it's behind
 	// a proxy, so let them specify that if they like
 	if addr[:4] != "http" {
@@ -48,7 +52,7 @@ func NewCouchDB(addr, database, user, pass string) (DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing version: %s", err)
 	}
-	return db, db.init()
+	return &db, db.init()
 }
 
 // init ensures that the database is configured correctly:
@@ -89,21 +93,72 @@ func (db CouchDB) init() error {
 		m["language"] = "javascript"
 	}
 	views := m["views"].(map[string]interface{})
-	// by_project maps projects to documents
-	// use reduce=false to get all documents, or
-	// reduce=true to get counts per project
+	// by_project keys documents on [user, project] so suites are
+	// scoped to the user that owns them. use reduce=false to get all
+	// documents, or reduce=true to get counts per project
 	views["by_project"] = map[string]interface{}{
 		"map": `function(doc) {
-		   emit(doc.project, doc);
+		   if (doc.user && doc.project && doc.test) {
+			   emit([doc.user, doc.project], doc);
+		   }
 	   }`,
 		"reduce": `function (keys, values, meh) {
 		   return keys.reduce(function (p, key) {
-			   var k = key[0];
+			   var k = key[0][1];
 			   p[k] = k in p ? p[k] + 1 : 1;
 			   return p;
 		   }, {});
 	   }`,
 	}
+	// by_token maps bearer tokens to the user doc that owns them, so
+	// RequireAuth can resolve a token to a username in one lookup
+	views["by_token"] = map[string]interface{}{
+		"map": `function(doc) {
+		   if (doc.type === "user" && doc.tokens) {
+			   doc.tokens.forEach(function (token) {
+				   emit(token, doc.user);
+			   });
+		   }
+	   }`,
+	}
+	// by_project_time keys each run on [user, project, id] (run ids
+	// are RFC3339 timestamps, so this also sorts chronologically) and
+	// maps it to its pass/fail/skip/duration counts, so trend buckets
+	// don't require fetching and parsing every suite document. reduce
+	// sums those counts, analogous to by_project's reduce.
+	views["by_project_time"] = map[string]interface{}{
+		"map": `function(doc) {
+		   if (!doc.user || !doc.project || !doc.test) {
+			   return;
+		   }
+		   var passed = 0, failed = 0, skipped = 0;
+		   (doc.tests || []).forEach(function (t) {
+			   var directive = t.directive || {};
+			   if (directive.type === "skip" || directive.type === "SKIP") {
+				   skipped++;
+			   } else if (t.ok) {
+				   passed++;
+			   } else {
+				   failed++;
+			   }
+		   });
+		   emit([doc.user, doc.project, doc.test], {
+			   passed: passed,
+			   failed: failed,
+			   skipped: skipped,
+			   duration: typeof doc.duration === "number" ? doc.duration : 0
+		   });
+	   }`,
+		"reduce": `function (keys, values, rereduce) {
+		   return values.reduce(function (p, v) {
+			   p.passed += v.passed;
+			   p.failed += v.failed;
+			   p.skipped += v.skipped;
+			   p.duration += v.duration;
+			   return p;
+		   }, {passed: 0, failed: 0, skipped: 0, duration: 0});
+	   }`,
+	}
 
 	b, err := json.Marshal(m)
 	if err != nil {
@@ -132,8 +187,53 @@ func (db CouchDB) init() error {
 	return nil
 }
 
-func (db CouchDB) GetProjects() ([]string, error) {
-	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_project")
+// viewKey JSON-encodes a view startkey/endkey component, e.g. a
+// []interface{}{user, project} compound key.
+func viewKey(parts ...interface{}) string {
+	b, _ := json.Marshal(parts)
+	return string(b)
+}
+
+// testDocID returns the document id a suite is stored under. Run ids
+// (test) are RFC3339 timestamps scoped only to the project that
+// produced them, so two users (or one user's two projects) can easily
+// land a run in the same second; namespacing the doc id by user and
+// project keeps those from colliding the way FileStore's
+// root/user/project/test path and SQLStore's (username, project, test)
+// primary key already do.
+func testDocID(user, project, test string) string {
+	return user + ":" + project + ":" + test
+}
+
+// ListUsers returns every user with at least one project document, so
+// a full-DB migration knows whose data to copy.
+func (db CouchDB) ListUsers() ([]string, error) {
+	q := url.Values{}
+	q.Set("group_level", "1")
+	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_project?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	var users []string
+	rows, _ := m["rows"].([]interface{})
+	for _, row := range rows {
+		key := row.(map[string]interface{})["key"].([]interface{})
+		users = append(users, key[0].(string))
+	}
+	return users, nil
+}
+
+func (db CouchDB) GetProjects(user string) ([]string, error) {
+	q := url.Values{}
+	q.Set("startkey", viewKey(user))
+	q.Set("endkey", viewKey(user, map[string]interface{}{}))
+	q.Set("group_level", "2")
+	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_project?" + q.Encode())
 	if err != nil {
 		return nil, err
 	}
@@ -142,18 +242,20 @@ func (db CouchDB) GetProjects() ([]string, error) {
 		return nil, err
 	}
 
-	rows := m["rows"].([]interface{})
-	match := rows[0].(map[string]interface{})
-	counts := match["value"].(map[string]interface{})
 	var projects []string
-	for project := range counts {
-		projects = append(projects, project)
+	rows, _ := m["rows"].([]interface{})
+	for _, row := range rows {
+		key := row.(map[string]interface{})["key"].([]interface{})
+		projects = append(projects, key[1].(string))
 	}
 	return projects, nil
 }
 
-func (db CouchDB) GetTests(project string) ([]string, error) {
-	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_project?reduce=false")
+func (db CouchDB) GetTests(user, project string) ([]string, error) {
+	q := url.Values{}
+	q.Set("reduce", "false")
+	q.Set("key", viewKey(user, project))
+	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_project?" + q.Encode())
 	if err != nil {
 		return nil, err
 	}
@@ -163,27 +265,72 @@ func (db CouchDB) GetTests(project string) ([]string, error) {
 	}
 
 	var tests []string
-	rows := m["rows"].([]interface{})
+	rows, _ := m["rows"].([]interface{})
 	for _, row := range rows {
 		// TODO: make this safer
 		val := row.(map[string]interface{})["value"].(map[string]interface{})
-		id := val["_id"].(string)
-		tests = append(tests, id)
+		tests = append(tests, val["test"].(string))
 	}
 	return tests, nil
 }
 
-func (db CouchDB) GetTest(project, test string) (*stein.Suite, error) {
-	resp, err := http.Get(db.addr + db.database + "/" + test)
+// BucketCounts returns per-run pass/fail/skip counts and durations for
+// user/project since the given time, read straight from by_project_time
+// so trend bucketing doesn't need to fetch and parse every suite.
+func (db CouchDB) BucketCounts(user, project string, since time.Time) ([]bucketCount, error) {
+	q := url.Values{}
+	q.Set("reduce", "false")
+	q.Set("startkey", viewKey(user, project, since.Format(time.RFC3339)))
+	q.Set("endkey", viewKey(user, project, map[string]interface{}{}))
+	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_project_time?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	var counts []bucketCount
+	rows, _ := m["rows"].([]interface{})
+	for _, row := range rows {
+		r := row.(map[string]interface{})
+		key := r["key"].([]interface{})
+		val := r["value"].(map[string]interface{})
+		counts = append(counts, bucketCount{
+			Test:     key[2].(string),
+			Passed:   int(val["passed"].(float64)),
+			Failed:   int(val["failed"].(float64)),
+			Skipped:  int(val["skipped"].(float64)),
+			Duration: time.Duration(val["duration"].(float64)) * time.Millisecond,
+		})
+	}
+	return counts, nil
+}
+
+func (db CouchDB) GetTest(user, project, test string) (*stein.Suite, error) {
+	resp, err := http.Get(db.addr + db.database + "/" + testDocID(user, project, test))
 	if err != nil {
 		return nil, err
 	}
 
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m["user"] != user || m["project"] != project {
+		return nil, fmt.Errorf("no such test: %s", test)
+	}
+
 	var s stein.Suite
-	return &s, json.NewDecoder(resp.Body).Decode(&s)
+	return &s, json.Unmarshal(b, &s)
 }
 
-func (db CouchDB) Save(project, test string, s *stein.Suite) error {
+func (db CouchDB) Save(user, project, test string, s *stein.Suite) error {
 	b, err := json.Marshal(s)
 	if err != nil {
 		return err
@@ -193,13 +340,15 @@ func (db CouchDB) Save(project, test string, s *stein.Suite) error {
 	if err != nil {
 		return err
 	}
+	m["user"] = user
 	m["project"] = project
+	m["test"] = test
 	b, err = json.Marshal(m)
 	if err != nil {
 		return err
 	}
 
-	testAddr := db.addr + db.database + "/" + test
+	testAddr := db.addr + db.database + "/" + testDocID(user, project, test)
 
 	var rev string
 	resp, err := http.Get(testAddr)
@@ -235,3 +384,136 @@ func (db CouchDB) Save(project, test string, s *stein.Suite) error {
 	resp.Body.Close()
 	return nil
 }
+
+// userDoc fetches the user account document, returning (nil, nil) if
+// it doesn't exist yet.
+func (db CouchDB) userDoc(user string) (map[string]interface{}, error) {
+	resp, err := http.Get(db.addr + db.database + "/user:" + user)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	var m map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// putUserDoc creates or updates the user account document, carrying
+// over _rev if it already exists.
+func (db CouchDB) putUserDoc(m map[string]interface{}) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	docAddr := db.addr + db.database + "/user:" + m["user"].(string)
+	req, err := http.NewRequest("PUT", docAddr, bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	if db.user != "" {
+		req.SetBasicAuth(db.user, db.pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	} else if resp.StatusCode >= 400 {
+		return fmt.Errorf("Error updating user document: %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (db CouchDB) Create(user, password string) error {
+	existing, err := db.userDoc(user)
+	if err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("user already exists: %s", user)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return db.putUserDoc(map[string]interface{}{
+		"type":     "user",
+		"user":     user,
+		"password": string(hash),
+		"tokens":   []string{},
+	})
+}
+
+func (db CouchDB) Authenticate(user, password string) (bool, error) {
+	m, err := db.userDoc(user)
+	if err != nil {
+		return false, err
+	} else if m == nil {
+		return false, nil
+	}
+	hash, _ := m["password"].(string)
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (db CouchDB) IssueToken(user string) (string, error) {
+	m, err := db.userDoc(user)
+	if err != nil {
+		return "", err
+	} else if m == nil {
+		return "", fmt.Errorf("no such user: %s", user)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	tokens, _ := m["tokens"].([]interface{})
+	m["tokens"] = append(tokens, token)
+	return token, db.putUserDoc(m)
+}
+
+func (db CouchDB) RevokeToken(token string) error {
+	user, err := db.UserForToken(token)
+	if err != nil {
+		return err
+	}
+	m, err := db.userDoc(user)
+	if err != nil {
+		return err
+	} else if m == nil {
+		return nil
+	}
+	tokens, _ := m["tokens"].([]interface{})
+	kept := tokens[:0]
+	for _, t := range tokens {
+		if t.(string) != token {
+			kept = append(kept, t)
+		}
+	}
+	m["tokens"] = kept
+	return db.putUserDoc(m)
+}
+
+func (db CouchDB) UserForToken(token string) (string, error) {
+	q := url.Values{}
+	q.Set("key", viewKey(token))
+	resp, err := http.Get(db.addr + db.database + "/_design/" + db.design + "/_view/by_token?" + q.Encode())
+	if err != nil {
+		return "", err
+	}
+	var m map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return "", err
+	}
+	rows, _ := m["rows"].([]interface{})
+	if len(rows) == 0 {
+		return "", fmt.Errorf("invalid token")
+	}
+	return rows[0].(map[string]interface{})["value"].(string), nil
+}
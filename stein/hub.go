@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/beatgammit/stein"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// safeConn pairs a websocket connection with the mutex that serializes
+// writes to it. gorilla/websocket panics on a concurrent write to one
+// connection, and a subscriber can be written to by Publish from
+// whichever of several concurrent StreamTest goroutines is producing
+// events for its project/test, so every write must go through this lock.
+// Reads aren't serialized since only StreamTest's own goroutine reads
+// its connection.
+type safeConn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *safeConn) writeMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteMessage(messageType, data)
+}
+
+// Hub fans out test-event deltas to every websocket client watching a
+// given project/test, so dashboards can update live instead of
+// polling GetTest.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[*safeConn]bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[*safeConn]bool)}
+}
+
+// streamKey scopes a subscription to the user that owns project/test,
+// so a dashboard authenticated as one user can never subscribe to
+// another user's live run even if it guesses their project name and
+// RFC3339 test id.
+func streamKey(user, project, test string) string {
+	return user + "/" + project + "/" + test
+}
+
+// Subscribe registers conn to receive deltas published for user's
+// project/test.
+func (h *Hub) Subscribe(user, project, test string, conn *safeConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := streamKey(user, project, test)
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[*safeConn]bool)
+	}
+	h.subs[key][conn] = true
+}
+
+func (h *Hub) Unsubscribe(user, project, test string, conn *safeConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[streamKey(user, project, test)], conn)
+}
+
+// Publish broadcasts delta to every subscriber of user's project/test,
+// dropping and closing any connection that fails to write.
+func (h *Hub) Publish(user, project, test string, delta []byte) {
+	key := streamKey(user, project, test)
+
+	h.mu.Lock()
+	conns := make([]*safeConn, 0, len(h.subs[key]))
+	for c := range h.subs[key] {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range conns {
+		if err := c.writeMessage(websocket.TextMessage, delta); err != nil {
+			h.Unsubscribe(user, project, test, c)
+			c.ws.Close()
+		}
+	}
+}
+
+// checkpointEvery bounds how many events accumulate before the suite
+// parsed so far is saved through the DB, so a dropped connection only
+// loses a small window of events rather than the whole run.
+const checkpointEvery = 20
+
+// accumulatedSuite merges stein.Parse results chunk by chunk as they
+// arrive instead of re-parsing everything received so far at every
+// checkpoint, so a streamed run of N events costs O(N) total rather
+// than O(N^2). stein itself has no incremental parser, so this only
+// avoids re-parsing bytes already accounted for — each new chunk is
+// still parsed whole by stein.Parse.
+type accumulatedSuite struct {
+	tests    []interface{}
+	duration time.Duration
+}
+
+// merge parses chunk, a newline-delimited run of stein events not yet
+// folded in, and adds its test cases and duration to the running total.
+func (a *accumulatedSuite) merge(chunk []byte) error {
+	s, err := stein.Parse(bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	m, tests := decodeSuite(s)
+	a.tests = append(a.tests, tests...)
+	if ms, ok := m["duration"].(float64); ok {
+		a.duration += time.Duration(ms) * time.Millisecond
+	}
+	return nil
+}
+
+// suite renders the tests and duration accumulated so far back into a
+// *stein.Suite by round-tripping through JSON, the same way every other
+// backend in this package treats stein.Suite as an opaque marshalable
+// blob.
+func (a *accumulatedSuite) suite() (*stein.Suite, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"tests":    a.tests,
+		"duration": float64(a.duration / time.Millisecond),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var s stein.Suite
+	return &s, json.Unmarshal(b, &s)
+}
+
+// StreamTest upgrades r/w to a websocket and reads newline-delimited
+// stein events from an in-progress test run, broadcasting each one to
+// subscribed dashboards via hub and periodically checkpointing the
+// suite accumulated so far through db.
+func StreamTest(hub *Hub, db DB, user, project, test string, w http.ResponseWriter, r *http.Request) error {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	conn := &safeConn{ws: ws}
+	defer conn.ws.Close()
+
+	hub.Subscribe(user, project, test, conn)
+	defer hub.Unsubscribe(user, project, test, conn)
+
+	var acc accumulatedSuite
+	var pending bytes.Buffer
+	var received int
+	for {
+		_, line, err := conn.ws.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		pending.Write(line)
+		pending.WriteByte('\n')
+		hub.Publish(user, project, test, line)
+
+		received++
+		if received%checkpointEvery == 0 {
+			if err := acc.merge(pending.Bytes()); err != nil {
+				return err
+			}
+			pending.Reset()
+			if err := checkpointSuite(db, user, project, test, &acc); err != nil {
+				return err
+			}
+		}
+	}
+	if pending.Len() > 0 {
+		if err := acc.merge(pending.Bytes()); err != nil {
+			return err
+		}
+	}
+	if received == 0 {
+		return nil
+	}
+	return checkpointSuite(db, user, project, test, &acc)
+}
+
+func checkpointSuite(db DB, user, project, test string, acc *accumulatedSuite) error {
+	s, err := acc.suite()
+	if err != nil {
+		return err
+	}
+	return db.Save(user, project, test, s)
+}
@@ -13,20 +13,41 @@ import (
 )
 
 var dbType string
+var sqlDriver string
+var dsn string
 
 func init() {
-	flag.StringVar(&dbType, "dbtype", "fs", "database type to use: fs, couchdb")
-	flag.Parse()
+	flag.StringVar(&dbType, "dbtype", "fs", "database type to use: fs, couchdb, sql")
+	flag.StringVar(&sqlDriver, "sqldriver", "sqlite3", "driver to use when -dbtype is sql: sqlite3, postgres")
+	flag.StringVar(&dsn, "dsn", "", "data source name to use when -dbtype is sql")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "convertdb" {
+		if err := convertdbMain(os.Args[2:]); err != nil {
+			log.Error("convertdb: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+	flag.Parse()
+
 	var db DB
+	var users Users
 	var err error
 	switch dbType {
 	case "fs":
-		db, err = NewFileStore("file_store")
+		var fs *FileStore
+		fs, err = NewFileStore("file_store")
+		db, users = fs, fs
 	case "couchdb":
-		db, err = NewCouchDB("localhost:5984", "test", "", "")
+		var cdb *CouchDB
+		cdb, err = NewCouchDB("localhost:5984", "test", "", "")
+		db, users = cdb, cdb
+	case "sql":
+		var sqlStore *SQLStore
+		sqlStore, err = NewSQLStore(sqlDriver, dsn)
+		db, users = sqlStore, sqlStore
 	default:
 		err = fmt.Errorf("Unsupported database type: %s", dbType)
 	}
@@ -37,10 +58,48 @@ func main() {
 		return
 	}
 
+	hub := NewHub()
+
 	m := martini.Classic()
 	m.Use(martini.Static("build/web"))
-	m.Get("/projects", func() (string, int) {
-		projs, err := db.GetProjects()
+
+	m.Post("/register", func(r *http.Request) (string, int) {
+		var creds struct{ User, Password string }
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			return err.Error(), 400
+		}
+		if err := users.Create(creds.User, creds.Password); err != nil {
+			return err.Error(), 500
+		}
+		token, err := users.IssueToken(creds.User)
+		if err != nil {
+			return err.Error(), 500
+		}
+		return token, 200
+	})
+
+	m.Post("/login", func(r *http.Request) (string, int) {
+		var creds struct{ User, Password string }
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			return err.Error(), 400
+		}
+		ok, err := users.Authenticate(creds.User, creds.Password)
+		if err != nil {
+			return err.Error(), 500
+		} else if !ok {
+			return "invalid credentials", 401
+		}
+		token, err := users.IssueToken(creds.User)
+		if err != nil {
+			return err.Error(), 500
+		}
+		return token, 200
+	})
+
+	auth := RequireAuth(users)
+
+	m.Get("/projects", auth, func(user authedUser) (string, int) {
+		projs, err := db.GetProjects(string(user))
 		if err != nil {
 			return err.Error(), 500
 		}
@@ -48,8 +107,18 @@ func main() {
 		return string(b), 200
 	})
 
-	m.Get("/projects/:project/tests", func(params martini.Params) (string, int) {
-		tests, err := db.GetTests(params["project"])
+	m.Get("/projects/:project/tests", auth, func(params martini.Params, user authedUser, r *http.Request) (string, int) {
+		var tests []string
+		var err error
+		if rdb, ok := db.(rangeableDB); ok {
+			since, until, limit, offset, perr := parseTestsRangeParams(r)
+			if perr != nil {
+				return perr.Error(), 400
+			}
+			tests, err = rdb.GetTestsRange(string(user), params["project"], since, until, limit, offset)
+		} else {
+			tests, err = db.GetTests(string(user), params["project"])
+		}
 		if err != nil {
 			return err.Error(), 500
 		}
@@ -57,26 +126,57 @@ func main() {
 		return string(b), 200
 	})
 
-	m.Post("/projects/:project/tests", func(params martini.Params, r *http.Request) (string, int) {
+	m.Post("/projects/:project/tests", auth, func(params martini.Params, user authedUser, r *http.Request) (string, int) {
 		id := time.Now().Format(time.RFC3339)
 		s, err := stein.Parse(r.Body)
 		if err != nil {
 			return err.Error(), 500
 		}
 
-		err = db.Save(params["project"], id, s)
+		err = db.Save(string(user), params["project"], id, s)
 		if err != nil {
 			return err.Error(), 500
 		}
 		return id, 200
 	})
-	m.Get("/projects/:project/tests/:test", func(params martini.Params) (string, int) {
-		s, err := db.GetTest(params["project"], params["test"])
+	m.Get("/projects/:project/tests/:test", auth, func(params martini.Params, user authedUser) (string, int) {
+		s, err := db.GetTest(string(user), params["project"], params["test"])
 		if err != nil {
 			return err.Error(), 500
 		}
 		b, _ := json.Marshal(s)
 		return string(b), 200
 	})
+	m.Get("/projects/:project/tests/:test/stream", auth, func(params martini.Params, user authedUser, w http.ResponseWriter, r *http.Request) {
+		if err := StreamTest(hub, db, string(user), params["project"], params["test"], w, r); err != nil {
+			log.Error("Error streaming test: %s", err)
+		}
+	})
+	m.Get("/projects/:project/trends", auth, func(params martini.Params, user authedUser, r *http.Request) (string, int) {
+		window, err := parseWindow(firstNonEmpty(r.URL.Query().Get("window"), "30d"))
+		if err != nil {
+			return fmt.Sprintf("invalid window: %s", err), 400
+		}
+		bucket, err := parseWindow(firstNonEmpty(r.URL.Query().Get("bucket"), "1d"))
+		if err != nil {
+			return fmt.Sprintf("invalid bucket: %s", err), 400
+		}
+		if window <= 0 {
+			return "window must be positive", 400
+		}
+		if bucket <= 0 {
+			return "bucket must be positive", 400
+		}
+
+		buckets, flaky, err := ComputeTrends(db, string(user), params["project"], time.Now().Add(-window), bucket)
+		if err != nil {
+			return err.Error(), 500
+		}
+		b, _ := json.Marshal(map[string]interface{}{
+			"buckets":   buckets,
+			"flakiness": flaky,
+		})
+		return string(b), 200
+	})
 	m.Run()
 }
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beatgammit/stein"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SQLStore persists projects, tests and accounts in a SQL database via
+// database/sql, so any driver with a compatible dialect (sqlite,
+// postgres) can back stein without a new DB implementation.
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+}
+
+// suiteColumnType picks the column type used to store a marshaled
+// suite: postgres gets real JSONB, other drivers fall back to TEXT.
+func suiteColumnType(driver string) string {
+	if driver == "postgres" {
+		return "JSONB"
+	}
+	return "TEXT"
+}
+
+// NewSQLStore opens dsn with driver ("sqlite3" or "postgres") and
+// applies the schema migrations, mirroring how CouchDB.init
+// provisions its design document on first connect.
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	s := &SQLStore{db: db, driver: driver}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLStore) migrate() error {
+	suiteCol := suiteColumnType(s.driver)
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			username TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS tokens (
+			token TEXT PRIMARY KEY,
+			username TEXT NOT NULL
+		)`,
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS tests (
+			username TEXT NOT NULL,
+			project TEXT NOT NULL,
+			test TEXT NOT NULL,
+			suite %s NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (username, project, test)
+		)`, suiteCol),
+		`CREATE INDEX IF NOT EXISTS tests_project_idx ON tests (username, project, created_at)`,
+		`CREATE TABLE IF NOT EXISTS results (
+			username TEXT NOT NULL,
+			project TEXT NOT NULL,
+			test TEXT NOT NULL,
+			passed INTEGER NOT NULL,
+			failed INTEGER NOT NULL,
+			skipped INTEGER NOT NULL,
+			duration_ms INTEGER NOT NULL,
+			PRIMARY KEY (username, project, test)
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("running migration %q: %s", stmt, err)
+		}
+	}
+	return nil
+}
+
+// rebind rewrites "?" placeholders to "$1", "$2", ... for drivers like
+// lib/pq that don't accept the sql package's default placeholder
+// syntax, so every query below can be written driver-agnostically.
+func (s *SQLStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *SQLStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+func (s *SQLStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *SQLStore) ListUsers() ([]string, error) {
+	rows, err := s.query(`SELECT DISTINCT username FROM tests ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLStore) GetProjects(user string) ([]string, error) {
+	rows, err := s.query(`SELECT DISTINCT project FROM tests WHERE username = ? ORDER BY project`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []string
+	for rows.Next() {
+		var project string
+		if err := rows.Scan(&project); err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+func (s *SQLStore) GetTests(user, project string) ([]string, error) {
+	return s.GetTestsRange(user, project, time.Time{}, time.Time{}, 0, 0)
+}
+
+// GetTestsRange lists tests for user/project ordered by newest first,
+// optionally bounded to [since, until) and paginated with limit/offset
+// — the date-range filtering and pagination the CouchDB by_project
+// view can't do efficiently. A zero since/until or non-positive limit
+// leaves that bound unrestricted.
+func (s *SQLStore) GetTestsRange(user, project string, since, until time.Time, limit, offset int) ([]string, error) {
+	query := `SELECT test FROM tests WHERE username = ? AND project = ?`
+	args := []interface{}{user, project}
+
+	if !since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, since)
+	}
+	if !until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, until)
+	}
+	query += ` ORDER BY created_at DESC`
+	if limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, offset)
+	}
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tests []string
+	for rows.Next() {
+		var test string
+		if err := rows.Scan(&test); err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
+	return tests, rows.Err()
+}
+
+// BucketCounts returns per-run pass/fail/skip counts and durations for
+// user/project since the given time, read straight from the results
+// table populated on every Save, so trend bucketing doesn't need to
+// fetch and re-parse every suite's JSON.
+func (s *SQLStore) BucketCounts(user, project string, since time.Time) ([]bucketCount, error) {
+	rows, err := s.query(
+		`SELECT r.test, r.passed, r.failed, r.skipped, r.duration_ms
+		 FROM results r JOIN tests t
+		   ON t.username = r.username AND t.project = r.project AND t.test = r.test
+		 WHERE r.username = ? AND r.project = ? AND t.created_at >= ?
+		 ORDER BY t.created_at`,
+		user, project, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []bucketCount
+	for rows.Next() {
+		var c bucketCount
+		var durationMs int64
+		if err := rows.Scan(&c.Test, &c.Passed, &c.Failed, &c.Skipped, &durationMs); err != nil {
+			return nil, err
+		}
+		c.Duration = time.Duration(durationMs) * time.Millisecond
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+func (s *SQLStore) GetTest(user, project, test string) (*stein.Suite, error) {
+	var raw []byte
+	err := s.queryRow(
+		`SELECT suite FROM tests WHERE username = ? AND project = ? AND test = ?`,
+		user, project, test,
+	).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var suite stein.Suite
+	return &suite, json.Unmarshal(raw, &suite)
+}
+
+func (s *SQLStore) Save(user, project, test string, suite *stein.Suite) error {
+	b, err := json.Marshal(suite)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.rebind(
+		`INSERT INTO tests (username, project, test, suite, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (username, project, test) DO UPDATE SET suite = excluded.suite`),
+		user, project, test, b, time.Now(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	stats := statsForSuite(suite)
+	_, err = tx.Exec(s.rebind(
+		`INSERT INTO results (username, project, test, passed, failed, skipped, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (username, project, test) DO UPDATE SET
+			passed = excluded.passed, failed = excluded.failed,
+			skipped = excluded.skipped, duration_ms = excluded.duration_ms`),
+		user, project, test, stats.Passed, stats.Failed, stats.Skipped, stats.Duration.Milliseconds(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Create(user, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`INSERT INTO users (username, password_hash) VALUES (?, ?)`, user, string(hash))
+	return err
+}
+
+func (s *SQLStore) Authenticate(user, password string) (bool, error) {
+	var hash string
+	err := s.queryRow(`SELECT password_hash FROM users WHERE username = ?`, user).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *SQLStore) IssueToken(user string) (string, error) {
+	var exists string
+	if err := s.queryRow(`SELECT username FROM users WHERE username = ?`, user).Scan(&exists); err != nil {
+		return "", fmt.Errorf("no such user: %s", user)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.exec(`INSERT INTO tokens (token, username) VALUES (?, ?)`, token, user)
+	return token, err
+}
+
+func (s *SQLStore) RevokeToken(token string) error {
+	_, err := s.exec(`DELETE FROM tokens WHERE token = ?`, token)
+	return err
+}
+
+func (s *SQLStore) UserForToken(token string) (string, error) {
+	var user string
+	err := s.queryRow(`SELECT username FROM tokens WHERE token = ?`, token).Scan(&user)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("invalid token")
+	}
+	return user, err
+}
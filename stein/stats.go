@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/beatgammit/stein"
+)
+
+// suiteStats is a generic summary of a suite's outcome, derived by
+// walking its JSON representation rather than its Go fields, since
+// every other backend in this package already treats stein.Suite as
+// an opaque, marshalable blob.
+type suiteStats struct {
+	Passed, Failed, Skipped int
+	Duration                time.Duration
+}
+
+// decodeSuite marshals s back through JSON to get at its fields
+// generically, returning the decoded document and its "tests" array
+// (or nil, nil on any decode failure).
+func decodeSuite(s *stein.Suite) (map[string]interface{}, []interface{}) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, nil
+	}
+	tests, _ := m["tests"].([]interface{})
+	return m, tests
+}
+
+// statsForSuite best-effort extracts pass/fail/skip counts and a
+// duration from a suite. It tolerates suites that don't have the
+// fields it looks for, returning zero counts rather than erroring, so
+// callers can use it for aggregation without assuming a rigid schema.
+func statsForSuite(s *stein.Suite) suiteStats {
+	var stats suiteStats
+
+	m, tests := decodeSuite(s)
+	for _, t := range tests {
+		test, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch {
+		case isSkipped(test):
+			stats.Skipped++
+		case test["ok"] == true:
+			stats.Passed++
+		default:
+			stats.Failed++
+		}
+	}
+
+	if ms, ok := m["duration"].(float64); ok {
+		stats.Duration = time.Duration(ms) * time.Millisecond
+	}
+	return stats
+}
+
+func isSkipped(test map[string]interface{}) bool {
+	directive, ok := test["directive"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	t, _ := directive["type"].(string)
+	return t == "skip" || t == "SKIP"
+}
+
+// caseOutcomes best-effort extracts each named test case's pass/fail
+// outcome from a suite, keyed by its description (falling back to its
+// name, then its position) so flakiness can be tracked per test case
+// across runs.
+func caseOutcomes(s *stein.Suite) map[string]bool {
+	_, tests := decodeSuite(s)
+	outcomes := make(map[string]bool, len(tests))
+	for i, t := range tests {
+		test, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := test["description"].(string)
+		if name == "" {
+			name, _ = test["name"].(string)
+		}
+		if name == "" {
+			name = fmt.Sprintf("test-%d", i+1)
+		}
+		outcomes[name] = test["ok"] == true
+	}
+	return outcomes
+}
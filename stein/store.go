@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beatgammit/stein"
+)
+
+// DB is the storage backend for stein projects and their test suites.
+// Every project and test is scoped to the user that owns it.
+type DB interface {
+	ListUsers() ([]string, error)
+	GetProjects(user string) ([]string, error)
+	GetTests(user, project string) ([]string, error)
+	GetTest(user, project, test string) (*stein.Suite, error)
+	Save(user, project, test string, s *stein.Suite) error
+}
+
+// rangeableDB is implemented by backends that can filter and paginate
+// a test listing server-side, e.g. SQLStore's indexed created_at
+// column. The HTTP API uses this instead of GetTests when available.
+type rangeableDB interface {
+	GetTestsRange(user, project string, since, until time.Time, limit, offset int) ([]string, error)
+}
+
+// FileStore persists projects and test suites as JSON files on disk,
+// one file per project/test pair, under a directory per user. It also
+// backs the Users interface, storing accounts in a single users.json
+// file alongside the per-user directories.
+type FileStore struct {
+	root string
+	mu   sync.Mutex
+
+	usersMu sync.Mutex
+	users   fileUsers
+}
+
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{root: root}
+	if err := fs.loadUsers(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) projectDir(user, project string) string {
+	return filepath.Join(fs.root, user, project)
+}
+
+// ListUsers returns every user with at least one project directory,
+// so a full-DB migration knows whose data to copy.
+func (fs *FileStore) ListUsers() ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(fs.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, e := range entries {
+		if e.IsDir() {
+			users = append(users, e.Name())
+		}
+	}
+	return users, nil
+}
+
+func (fs *FileStore) GetProjects(user string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(filepath.Join(fs.root, user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var projects []string
+	for _, e := range entries {
+		if e.IsDir() {
+			projects = append(projects, e.Name())
+		}
+	}
+	return projects, nil
+}
+
+func (fs *FileStore) GetTests(user, project string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(fs.projectDir(user, project))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tests []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			tests = append(tests, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	return tests, nil
+}
+
+func (fs *FileStore) GetTest(user, project, test string) (*stein.Suite, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, err := ioutil.ReadFile(filepath.Join(fs.projectDir(user, project), test+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var s stein.Suite
+	return &s, json.Unmarshal(b, &s)
+}
+
+func (fs *FileStore) Save(user, project, test string, s *stein.Suite) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir := fs.projectDir(user, project)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, test+".json"), b, 0644)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TrendBucket summarizes pass/fail/skip counts and mean duration for
+// one time bucket of a project's history.
+type TrendBucket struct {
+	Start          time.Time `json:"start"`
+	Passed         int       `json:"passed"`
+	Failed         int       `json:"failed"`
+	Skipped        int       `json:"skipped"`
+	MeanDurationMs float64   `json:"meanDurationMs"`
+
+	totalDuration time.Duration
+	runs          int
+}
+
+// TestFlakiness is how often a named test case flipped pass/fail
+// state between adjacent runs it appeared in, as a fraction of those
+// transitions (0 = always stable, 1 = flipped every single run).
+type TestFlakiness struct {
+	Test  string  `json:"test"`
+	Score float64 `json:"score"`
+}
+
+// bucketCount is one run's aggregate counts, keyed by its test id so
+// it can be placed into a time bucket.
+type bucketCount struct {
+	Test     string
+	Passed   int
+	Failed   int
+	Skipped  int
+	Duration time.Duration
+}
+
+// bucketCounter is implemented by backends that can compute per-run
+// counts server-side instead of loading and parsing every suite, e.g.
+// CouchDB's by_project_time view.
+type bucketCounter interface {
+	BucketCounts(user, project string, since time.Time) ([]bucketCount, error)
+}
+
+// ComputeTrends buckets every run for user/project since `since` into
+// `bucket`-sized windows, and scores each named test case's
+// flakiness. Backends that implement bucketCounter (CouchDB and
+// SQLStore) get their counts from it; flakiness always needs each
+// suite's individual test-case outcomes, so every suite is still
+// fetched with GetTest, and for FileStore the counts are computed in
+// that same pass.
+func ComputeTrends(db DB, user, project string, since time.Time, bucket time.Duration) ([]TrendBucket, []TestFlakiness, error) {
+	var counts []bucketCount
+	// Decide once, before the loop, whether counts come from the
+	// backend's view or need to be computed in-process below — doing
+	// this per-iteration (e.g. "if counts == nil") would stop
+	// appending as soon as the first in-process run was added.
+	bc, viaView := db.(bucketCounter)
+	if viaView {
+		var err error
+		counts, err = bc.BucketCounts(user, project, since)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tests, err := db.GetTests(user, project)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(tests) // test ids are RFC3339 timestamps, so this is chronological
+
+	history := map[string][]bool{}
+	for _, test := range tests {
+		if ts, err := time.Parse(time.RFC3339, test); err == nil && ts.Before(since) {
+			continue
+		}
+
+		s, err := db.GetTest(user, project, test)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, ok := range caseOutcomes(s) {
+			history[name] = append(history[name], ok)
+		}
+
+		if !viaView {
+			stats := statsForSuite(s)
+			counts = append(counts, bucketCount{
+				Test: test, Passed: stats.Passed, Failed: stats.Failed,
+				Skipped: stats.Skipped, Duration: stats.Duration,
+			})
+		}
+	}
+
+	return bucketize(counts, since, bucket), flakinessFromHistory(history), nil
+}
+
+func bucketize(counts []bucketCount, since time.Time, bucket time.Duration) []TrendBucket {
+	byStart := map[int64]*TrendBucket{}
+	var order []int64
+
+	for _, c := range counts {
+		ts, err := time.Parse(time.RFC3339, c.Test)
+		if err != nil {
+			continue
+		}
+		start := since.Add((ts.Sub(since) / bucket) * bucket)
+		key := start.Unix()
+
+		b, ok := byStart[key]
+		if !ok {
+			b = &TrendBucket{Start: start}
+			byStart[key] = b
+			order = append(order, key)
+		}
+		b.Passed += c.Passed
+		b.Failed += c.Failed
+		b.Skipped += c.Skipped
+		b.totalDuration += c.Duration
+		b.runs++
+	}
+
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	buckets := make([]TrendBucket, 0, len(order))
+	for _, key := range order {
+		b := byStart[key]
+		if b.runs > 0 {
+			b.MeanDurationMs = float64(b.totalDuration.Milliseconds()) / float64(b.runs)
+		}
+		buckets = append(buckets, *b)
+	}
+	return buckets
+}
+
+func flakinessFromHistory(history map[string][]bool) []TestFlakiness {
+	var flaky []TestFlakiness
+	for name, outcomes := range history {
+		if len(outcomes) < 2 {
+			continue
+		}
+		flips := 0
+		for i := 1; i < len(outcomes); i++ {
+			if outcomes[i] != outcomes[i-1] {
+				flips++
+			}
+		}
+		flaky = append(flaky, TestFlakiness{
+			Test:  name,
+			Score: float64(flips) / float64(len(outcomes)-1),
+		})
+	}
+	sort.Slice(flaky, func(i, j int) bool { return flaky[i].Score > flaky[j].Score })
+	return flaky
+}
+
+// parseTestsRangeParams reads the optional since/until/limit/offset
+// query parameters used to filter and paginate a test listing on
+// backends that support it (see rangeableDB). Omitted parameters
+// leave that bound unrestricted.
+func parseTestsRangeParams(r *http.Request) (since, until time.Time, limit, offset int, err error) {
+	q := r.URL.Query()
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// firstNonEmpty returns s if it's non-empty, otherwise def.
+func firstNonEmpty(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// parseWindow parses a duration like "30d" or "1h"; time.ParseDuration
+// doesn't support day units, which the trends API's window/bucket
+// parameters rely on.
+func parseWindow(s string) (time.Duration, error) {
+	if len(s) > 0 && s[len(s)-1] == 'd' {
+		days, err := time.ParseDuration(s[:len(s)-1] + "h")
+		if err != nil {
+			return 0, err
+		}
+		return days * 24, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/beatgammit/stein"
+)
+
+// fakeDB is a minimal in-process DB (no bucketCounter) so
+// ComputeTrends exercises its in-process count path.
+type fakeDB struct {
+	tests []string
+}
+
+func (f *fakeDB) ListUsers() ([]string, error)                    { return nil, nil }
+func (f *fakeDB) GetProjects(user string) ([]string, error)       { return nil, nil }
+func (f *fakeDB) GetTests(user, project string) ([]string, error) { return f.tests, nil }
+func (f *fakeDB) GetTest(user, project, test string) (*stein.Suite, error) {
+	return &stein.Suite{}, nil
+}
+func (f *fakeDB) Save(user, project, test string, s *stein.Suite) error { return nil }
+
+func TestComputeTrendsAggregatesEveryRun(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := &fakeDB{tests: []string{
+		since.Add(1 * time.Hour).Format(time.RFC3339),
+		since.Add(2 * time.Hour).Format(time.RFC3339),
+		since.Add(3 * time.Hour).Format(time.RFC3339),
+	}}
+
+	buckets, _, err := ComputeTrends(db, "alice", "proj", since, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("ComputeTrends: %s", err)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("expected all 3 runs to land in a single day-sized bucket, got %d buckets", len(buckets))
+	}
+	if got := buckets[0].runs; got != 3 {
+		t.Fatalf("expected the bucket to aggregate all 3 runs, got %d (an earlier bug dropped every run after the first)", got)
+	}
+}
+
+func TestBucketize(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	counts := []bucketCount{
+		{Test: since.Add(1 * time.Hour).Format(time.RFC3339), Passed: 1, Duration: time.Second},
+		{Test: since.Add(2 * time.Hour).Format(time.RFC3339), Passed: 1, Failed: 1, Duration: 3 * time.Second},
+		{Test: since.Add(25 * time.Hour).Format(time.RFC3339), Skipped: 1},
+	}
+
+	buckets := bucketize(counts, since, 24*time.Hour)
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 day-buckets, got %d", len(buckets))
+	}
+
+	first := buckets[0]
+	if first.Passed != 2 || first.Failed != 1 {
+		t.Fatalf("expected first bucket to aggregate both early runs, got %+v", first)
+	}
+	if want := 2000.0; first.MeanDurationMs != want {
+		t.Fatalf("expected mean duration %v, got %v", want, first.MeanDurationMs)
+	}
+
+	second := buckets[1]
+	if second.Skipped != 1 {
+		t.Fatalf("expected second bucket to hold the later run, got %+v", second)
+	}
+}
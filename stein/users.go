@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/codegangsta/martini"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users manages accounts and the API tokens used to authenticate them.
+type Users interface {
+	Create(user, password string) error
+	Authenticate(user, password string) (bool, error)
+	IssueToken(user string) (string, error)
+	RevokeToken(token string) error
+	UserForToken(token string) (string, error)
+}
+
+// fileUsers is the on-disk shape persisted to users.json: bcrypt
+// password hashes keyed by username, and tokens keyed by the token
+// string itself so lookups on request don't require a scan.
+type fileUsers struct {
+	Passwords map[string][]byte `json:"passwords"`
+	Tokens    map[string]string `json:"tokens"`
+}
+
+func (fs *FileStore) usersPath() string {
+	return filepath.Join(fs.root, "users.json")
+}
+
+func (fs *FileStore) loadUsers() error {
+	fs.usersMu.Lock()
+	defer fs.usersMu.Unlock()
+
+	b, err := ioutil.ReadFile(fs.usersPath())
+	if os.IsNotExist(err) {
+		fs.users = fileUsers{Passwords: map[string][]byte{}, Tokens: map[string]string{}}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &fs.users)
+}
+
+// saveUsers must be called with fs.usersMu held.
+func (fs *FileStore) saveUsers() error {
+	b, err := json.Marshal(fs.users)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fs.usersPath(), b, 0600)
+}
+
+func (fs *FileStore) Create(user, password string) error {
+	fs.usersMu.Lock()
+	defer fs.usersMu.Unlock()
+
+	if _, ok := fs.users.Passwords[user]; ok {
+		return fmt.Errorf("user already exists: %s", user)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fs.users.Passwords[user] = hash
+	return fs.saveUsers()
+}
+
+func (fs *FileStore) Authenticate(user, password string) (bool, error) {
+	fs.usersMu.Lock()
+	hash, ok := fs.users.Passwords[user]
+	fs.usersMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (fs *FileStore) IssueToken(user string) (string, error) {
+	fs.usersMu.Lock()
+	defer fs.usersMu.Unlock()
+
+	if _, ok := fs.users.Passwords[user]; !ok {
+		return "", fmt.Errorf("no such user: %s", user)
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	fs.users.Tokens[token] = user
+	return token, fs.saveUsers()
+}
+
+func (fs *FileStore) RevokeToken(token string) error {
+	fs.usersMu.Lock()
+	defer fs.usersMu.Unlock()
+
+	delete(fs.users.Tokens, token)
+	return fs.saveUsers()
+}
+
+func (fs *FileStore) UserForToken(token string) (string, error) {
+	fs.usersMu.Lock()
+	defer fs.usersMu.Unlock()
+
+	user, ok := fs.users.Tokens[token]
+	if !ok {
+		return "", fmt.Errorf("invalid token")
+	}
+	return user, nil
+}
+
+// newToken generates a random bearer token suitable for API auth.
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RequireAuth returns martini middleware that rejects requests without
+// a valid "Authorization: Bearer <token>" header. On success it maps
+// the authenticated username into the request context as an authedUser
+// so handlers can scope projects to their owner.
+func RequireAuth(users Users) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if len(auth) <= len(prefix) || auth[:len(prefix)] != prefix {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		user, err := users.UserForToken(auth[len(prefix):])
+		if err != nil {
+			http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		c.Map(authedUser(user))
+	}
+}
+
+// authedUser is the authenticated username, injected into the martini
+// context by RequireAuth for handlers that require a logged-in user.
+type authedUser string